@@ -1,26 +1,27 @@
 package process_request
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"strings"
-	"sync"
 
-	yaml "gopkg.in/yaml.v3"
+	"github.com/anchore/grype/grype"
+	grypematch "github.com/anchore/grype/grype/match"
+	"github.com/anchore/grype/grype/matcher"
+	"github.com/anchore/grype/grype/pkg"
+	"github.com/anchore/stereoscope"
+	"github.com/anchore/stereoscope/pkg/image"
+	pkgsource "github.com/anchore/syft/syft/source"
 
 	wssc "github.com/armosec/capacketsgo/apis"
 	cs "github.com/armosec/capacketsgo/containerscan"
 )
 
-var anchoreBinaryName = "/grype-cmd"
 var anchoreDirectoryName = "/anchore-resources"
 var anchoreDirectoryPath string
-var mutex_edit_conf *sync.Mutex
 
 type Application struct {
 	ConfigPath         string
@@ -72,8 +73,6 @@ type Database struct {
 	ValidateByHashOnStart bool   `mapstructure:"validate-by-hash-on-start"`
 }
 
-type Severity int
-
 type registry struct {
 	InsecureSkipTLSVerify bool                  `yaml:"insecure-skip-tls-verify" json:"insecure-skip-tls-verify" mapstructure:"insecure-skip-tls-verify"`
 	InsecureUseHTTP       bool                  `yaml:"insecure-use-http" json:"insecure-use-http" mapstructure:"insecure-use-http"`
@@ -99,6 +98,11 @@ type JSONReport struct {
 	Source     *source      `json:"source"`
 	Distro     distribution `json:"distro"`
 	Descriptor descriptor   `json:"descriptor"`
+
+	// image is the stereoscope image the scan pulled, kept around so
+	// PackageHandlerForDistro can read package databases out of the layer
+	// that was actually scanned instead of the kubevuln host's own.
+	image *image.Image
 }
 
 type Match struct {
@@ -261,35 +265,11 @@ type AnchoreLayers struct {
 	Size      uint64 `json:"size"`
 }
 
-func copyFileToOtherPath(src, dst string) error {
-	if _, err := os.Stat(dst); os.IsNotExist(err) {
-		in, err := os.Open(src)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
-
-		out, err := os.Create(dst)
-		if err != nil {
-			return err
-		}
-		err = os.Chmod(dst, 0775)
-		if err != nil {
-			return err
-		}
-		defer out.Close()
-
-		_, err = io.Copy(out, in)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
+// CreateAnchoreResourcesDirectoryAndFiles prepares the on-disk cache directory
+// used by the embedded grype vulnerability DB. Registry credentials are no
+// longer persisted here - they travel with each scan request instead.
 func CreateAnchoreResourcesDirectoryAndFiles() {
 
-	mutex_edit_conf = &sync.Mutex{}
 	dir, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
@@ -305,115 +285,213 @@ func CreateAnchoreResourcesDirectoryAndFiles() {
 	if err != nil {
 		// log.Fatal(err)
 	}
+}
 
-	config_data := Application{
-		CheckForAppUpdate: true,
-		Output:            "json",
-		Scope:             "Squashed",
-		Db: Database{
-			AutoUpdate: true,
-			Dir:        anchoreDirectoryPath + "/Db",
-			UpdateURL:  "https://toolbox-data.anchore.io/grype/databases/listing.json",
-		},
-		Registry: registry{
-			InsecureSkipTLSVerify: false,
-			InsecureUseHTTP:       false,
-			Auth:                  []RegistryCredentials{},
-		},
+// registryOptionsForCredentials builds the per-request registry auth grype
+// needs to pull a (possibly private) image. Unlike the previous config.yaml
+// approach, these options never touch disk and never leak between concurrent
+// scans.
+func registryOptionsForCredentials(creds *wssc.Credentials) *image.RegistryOptions {
+	registryOptions := &image.RegistryOptions{
+		InsecureSkipTLSVerify: false,
 	}
-	config_yaml_data, err := yaml.Marshal(&config_data)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = ioutil.WriteFile(anchoreDirectoryPath+"/.grype"+"/config.yaml", config_yaml_data, 0755)
-	if err != nil {
-		log.Fatal(err)
+
+	if creds != nil && creds.Username != "" && creds.Password != "" {
+		registryOptions.Credentials = []image.RegistryCredentials{
+			{
+				Username: creds.Username,
+				Password: creds.Password,
+			},
+		}
 	}
 
-	copyFileToOtherPath(dir+"/grype-cmd", anchoreDirectoryPath+anchoreBinaryName)
+	return registryOptions
 }
 
-func AddCredentialsToAnchoreConfiguratioFile(username string, password string) error {
-	var App Application
+// GetAnchoreScanRes catalogs scanCmd.ImageTag with syft and matches the
+// resulting packages against the grype vulnerability DB, in-process. This
+// replaces the previous fork/exec of a bundled grype-cmd binary, so
+// per-request credentials no longer need to be serialized into a shared
+// config file and scans no longer serialize on a single mutex.
+func GetAnchoreScanRes(scanCmd *wssc.WebsocketScanCommand) (*JSONReport, error) {
 
-	mutex_edit_conf.Lock()
+	registryOptions := registryOptionsForCredentials(scanCmd.Credentials)
+	providerConfig := pkg.ProviderConfig{
+		SyftProviderConfig: pkg.SyftProviderConfig{
+			RegistryOptions: registryOptions,
+		},
+	}
 
-	bytes, err := ioutil.ReadAll(strings.NewReader(anchoreDirectoryPath + "/config.yaml"))
+	packages, pkgContext, _, err := pkg.Provide(scanCmd.ImageTag, providerConfig)
 	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+		return nil, err
 	}
-	err = yaml.Unmarshal(bytes, &App)
+
+	vulnerabilityDB, dbStatus, err := grype.LoadVulnerabilityDB(anchoreDirectoryPath+"/.grype/db", true)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := grype.FindVulnerabilitiesForPackage(vulnerabilityDB, pkgContext.Distro, matcher.DefaultMatchers(), packages)
 	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+		return nil, err
 	}
-	App.Registry.Auth = append(App.Registry.Auth, RegistryCredentials{Username: username, Password: password})
-	config_yaml_data, err := yaml.Marshal(&App)
-	err = ioutil.WriteFile(anchoreDirectoryPath+"/.grype"+"/config.yaml", config_yaml_data, 0)
+
+	report := newJSONReport(matches, pkgContext, dbStatus)
+
+	img, err := stereoscope.GetImage(context.Background(), scanCmd.ImageTag, stereoscope.WithRegistryOptions(*registryOptions))
 	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+		// Vulnerability matching already succeeded above; file-to-vuln
+		// attribution just falls back to returning no files for this scan.
+		log.Printf("warning: failed to open %s for package file-list resolution: %v", scanCmd.ImageTag, err)
+	} else {
+		report.image = img
 	}
 
-	mutex_edit_conf.Unlock()
-	return nil
+	return report, nil
 }
 
-func RemoveCredentialsFromAnchoreConfiguratioFile(username string, password string) error {
-	var App Application
+// Close releases the stereoscope image GetAnchoreScanRes pulled for package
+// file-list resolution, removing the layer contents it unpacked to disk.
+// Callers should close the report once AnchoreStructConversion is done with
+// it.
+func (r *JSONReport) Close() {
+	if r == nil || r.image == nil {
+		return
+	}
 
-	mutex_edit_conf.Lock()
+	if err := r.image.Cleanup(); err != nil {
+		log.Printf("warning: failed to clean up scanned image resources: %v", err)
+	}
+}
 
-	bytes, err := ioutil.ReadAll(strings.NewReader(anchoreDirectoryPath + "/.grype" + "/config.yaml"))
-	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+// newJSONReport maps grype's native match results onto the JSONReport shape
+// the old grype-cmd binary produced on stdout.
+func newJSONReport(matches []grypematch.Match, pkgContext pkg.Context, dbStatus interface{}) *JSONReport {
+	var target interface{}
+	if pkgContext.Source != nil {
+		target = reinterpretAsMap(pkgContext.Source.Metadata)
 	}
-	err = yaml.Unmarshal(bytes, &App)
-	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+
+	report := &JSONReport{
+		Matches: make([]Match, 0, len(matches)),
+		Source: &source{
+			Type:   "image",
+			Target: target,
+		},
+		Distro: distroFromContext(pkgContext),
+		Descriptor: descriptor{
+			Name:                  "grype",
+			VulnerabilityDbStatus: dbStatus,
+		},
 	}
-	for i := 0; i < (len(App.Registry.Auth)); {
 
-		if username == App.Registry.Auth[i].Username && password == App.Registry.Auth[i].Password {
-			App.Registry.Auth = append(App.Registry.Auth[:i], App.Registry.Auth[i+1:]...)
-			break
+	for _, m := range matches {
+		relatedVulnerabilities := make([]VulnerabilityMetadata, 0, len(m.RelatedVulnerabilities))
+		for _, rv := range m.RelatedVulnerabilities {
+			relatedVulnerabilities = append(relatedVulnerabilities, VulnerabilityMetadata{
+				ID:          rv.ID,
+				DataSource:  rv.DataSource,
+				Namespace:   rv.Namespace,
+				Severity:    rv.Severity,
+				URLs:        rv.URLs,
+				Description: rv.Description,
+			})
 		}
-		i++
-	}
-	config_yaml_data, err := yaml.Marshal(&App)
-	err = ioutil.WriteFile(anchoreDirectoryPath+"/.grype"+"/config.yaml", config_yaml_data, 0755)
-	if err != nil {
-		mutex_edit_conf.Unlock()
-		return err
+
+		// GetPackagesInLayer reads the matched package names out of
+		// MatchDetails[].SearchedBy, so carry them over as generic maps.
+		matchDetails := make([]MatchDetails, 0, len(m.Details))
+		for _, d := range m.Details {
+			matchDetails = append(matchDetails, MatchDetails{
+				Matcher:    string(d.Matcher),
+				SearchedBy: reinterpretAsMap(d.SearchedBy),
+				Found:      reinterpretAsMap(d.Found),
+			})
+		}
+
+		report.Matches = append(report.Matches, Match{
+			Vulnerability: Vulnerability{
+				VulnerabilityMetadata: VulnerabilityMetadata{
+					ID:          m.Vulnerability.ID,
+					DataSource:  m.Vulnerability.DataSource,
+					Namespace:   m.Vulnerability.Namespace,
+					Severity:    m.Vulnerability.Severity,
+					URLs:        m.Vulnerability.URLs,
+					Description: m.Vulnerability.Description,
+				},
+				Fix: Fix{
+					Versions: m.Vulnerability.Fix.Versions,
+					State:    m.Vulnerability.Fix.State,
+				},
+			},
+			RelatedVulnerabilities: relatedVulnerabilities,
+			MatchDetails:           matchDetails,
+			Artifact: Package{
+				Name:      m.Package.Name,
+				Version:   m.Package.Version,
+				Type:      Type(m.Package.Type),
+				PURL:      m.Package.PURL,
+				Locations: convertLocations(m.Package.Locations),
+			},
+		})
 	}
 
-	mutex_edit_conf.Unlock()
-	return nil
+	return report
 }
 
-func GetAnchoreScanRes(scanCmd *wssc.WebsocketScanCommand) (*JSONReport, error) {
+// convertLocations maps syft's location set onto this package's Location,
+// field by field - they're unrelated named types despite the shared shape.
+func convertLocations(locations pkgsource.LocationSet) []Location {
+	syftLocations := locations.ToSlice()
+	out := make([]Location, 0, len(syftLocations))
+	for _, loc := range syftLocations {
+		out = append(out, Location{
+			RealPath:     loc.RealPath,
+			VirtualPath:  loc.VirtualPath,
+			FileSystemID: loc.FileSystemID,
+		})
+	}
+	return out
+}
 
-	vuln_anchore_report := &JSONReport{}
-	cmd := exec.Command(anchoreDirectoryPath+anchoreBinaryName, scanCmd.ImageTag, "-o", "json")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if scanCmd.Credentials != nil && scanCmd.Credentials.Username != "" && scanCmd.Credentials.Password != "" {
-		AddCredentialsToAnchoreConfiguratioFile(scanCmd.Credentials.Username, scanCmd.Credentials.Password)
+// distroFromContext copies the distro syft detected onto JSONReport.Distro.
+func distroFromContext(pkgContext pkg.Context) distribution {
+	if pkgContext.Distro == nil {
+		return distribution{}
 	}
-	err := cmd.Run()
-	if scanCmd.Credentials != nil && scanCmd.Credentials.Username != "" && scanCmd.Credentials.Password != "" {
-		RemoveCredentialsFromAnchoreConfiguratioFile(scanCmd.Credentials.Username, scanCmd.Credentials.Password)
+
+	idLike := ""
+	if len(pkgContext.Distro.IDLike) > 0 {
+		idLike = strings.Join(pkgContext.Distro.IDLike, " ")
+	}
+
+	return distribution{
+		Name:    pkgContext.Distro.Name,
+		Version: pkgContext.Distro.VersionID,
+		IDLike:  idLike,
 	}
+}
+
+// reinterpretAsMap round-trips v through JSON so AnchoreStructConversion's
+// map[string]interface{} assertions on JSONReport.Source.Target keep working
+// regardless of whether the report came from json.Unmarshal (the old
+// grype-cmd path) or was built from grype/syft's concrete types directly
+// (this in-process path). Returns nil if v can't be marshaled.
+func reinterpretAsMap(v interface{}) interface{} {
+	data, err := json.Marshal(v)
 	if err != nil {
-		return nil, err
+		log.Printf("warning: failed to reinterpret scan source: %v", err)
+		return nil
 	}
-	json.Unmarshal(out.Bytes(), vuln_anchore_report)
 
-	return vuln_anchore_report, nil
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		log.Printf("warning: failed to reinterpret scan source: %v", err)
+		return nil
+	}
 
+	return out
 }
 
 func convertToPkgFiles(fileList *[]string) *cs.PkgFiles {
@@ -431,9 +509,8 @@ func GetPackagesInLayer(layer string, anchore_vuln_struct *JSONReport, packageMa
 
 	packages := make(cs.LinuxPkgs, 0)
 	featureToFileList := make(map[string]*cs.PkgFiles)
+	seenPackages := make(map[string]bool)
 	var pkgResolved map[string][]string //holds the mapping
-	var Files *cs.PkgFiles
-	linuxPackage := cs.LinuxPackage{}
 
 	if packageManager != nil {
 
@@ -446,6 +523,13 @@ func GetPackagesInLayer(layer string, anchore_vuln_struct *JSONReport, packageMa
 						package_data := map_search_by_data["package"].(map[string]interface{})
 						if package_data["name"] != nil {
 							package_name := package_data["name"].(string)
+							if seenPackages[package_name] {
+								continue
+							}
+							seenPackages[package_name] = true
+
+							linuxPackage := cs.LinuxPackage{PackageName: package_name}
+
 							if files, ok := featureToFileList[package_name]; !ok {
 								fileList, err := packageManager.readFileListForPackage(package_name)
 								if err != nil {
@@ -470,7 +554,7 @@ func GetPackagesInLayer(layer string, anchore_vuln_struct *JSONReport, packageMa
 
 								if len(*fileList) > 0 {
 									log.Printf("package %s added files", package_name)
-									Files = convertToPkgFiles(fileList)
+									Files := convertToPkgFiles(fileList)
 									linuxPackage.Files = *Files
 									featureToFileList[package_name] = Files
 								} else {
@@ -479,19 +563,21 @@ func GetPackagesInLayer(layer string, anchore_vuln_struct *JSONReport, packageMa
 							} else {
 								linuxPackage.Files = *files
 							}
-							linuxPackage.PackageName = package_name
+
+							packages = append(packages, linuxPackage)
 						}
 					}
 				}
 			}
 		}
-		packages = append(packages, linuxPackage)
 	}
 
 	return packages
 }
 
-func AnchoreStructConversion(anchore_vuln_struct *JSONReport) (*cs.LayersList, error) {
+// AnchoreStructConversion reshapes a grype JSONReport into the per-layer
+// cs.LayersList the rest of kubevuln consumes.
+func AnchoreStructConversion(anchore_vuln_struct *JSONReport, orientByCVE bool) (*cs.LayersList, error) {
 	layersList := make(cs.LayersList, 0)
 
 	if anchore_vuln_struct.Source != nil {
@@ -507,6 +593,7 @@ func AnchoreStructConversion(anchore_vuln_struct *JSONReport) (*cs.LayersList, e
 			}
 			scanRes.Vulnerabilities = make(cs.VulnerabilitiesList, 0)
 			parentLayerHash = layer["digest"].(string)
+			seenVulns := make(map[string]bool)
 			for _, match := range anchore_vuln_struct.Matches {
 				for _, location := range match.Artifact.Locations {
 					if location.FileSystemID == layer["digest"].(string) {
@@ -539,12 +626,30 @@ func AnchoreStructConversion(anchore_vuln_struct *JSONReport) (*cs.LayersList, e
 								},
 							},
 						}
+
+						if orientByCVE {
+							orientVulnerabilityByCVE(&vuln, match)
+
+							// Re-keying onto a CVE can make several vendor-advisory
+							// matches collapse onto the same vuln; only this path
+							// needs the dedupe, so the flag off keeps its original
+							// one-entry-per-match behavior.
+							dedupeKey := vuln.Name + "|" + vuln.RelatedPackageName + "|" + vuln.PackageVersion
+							if seenVulns[dedupeKey] {
+								break
+							}
+							seenVulns[dedupeKey] = true
+						}
+
 						scanRes.Vulnerabilities = append(scanRes.Vulnerabilities, vuln)
 						break
 					}
 				}
 			}
 
+			packageManager := PackageHandlerForDistro(anchore_vuln_struct.Distro, layer["digest"].(string), anchore_vuln_struct.image)
+			scanRes.Packages = GetPackagesInLayer(layer["digest"].(string), anchore_vuln_struct, packageManager)
+
 			layersList = append(layersList, scanRes)
 		}
 	}
@@ -552,20 +657,81 @@ func AnchoreStructConversion(anchore_vuln_struct *JSONReport) (*cs.LayersList, e
 	return &layersList, nil
 }
 
-func GetAnchoreScanResults(scanCmd *wssc.WebsocketScanCommand) (*cs.LayersList, error) {
+// orientVulnerabilityByCVE re-keys vuln onto the highest-severity related
+// CVE, if any. cs.Vulnerability has no AdvisoryIDs field, so the original
+// vendor advisory ID is kept as a prefix on Description instead.
+func orientVulnerabilityByCVE(vuln *cs.Vulnerability, match Match) {
+	var best *VulnerabilityMetadata
+	for i := range match.RelatedVulnerabilities {
+		related := &match.RelatedVulnerabilities[i]
+		if !strings.HasPrefix(related.ID, "CVE-") {
+			continue
+		}
+		if best == nil || severityRank(related.Severity) > severityRank(best.Severity) {
+			best = related
+		}
+	}
 
-	log.Println("before GetAnchoreScanRes " + scanCmd.ImageTag)
-	anchore_vuln_struct, err := GetAnchoreScanRes(scanCmd)
-	if err != nil {
-		return nil, err
+	if best == nil {
+		return
+	}
+
+	originalAdvisoryID := vuln.Name
+	vuln.Name = best.ID
+	vuln.Description = fmt.Sprintf("(originally reported as %s) %s", originalAdvisoryID, best.Description)
+	vuln.Severity = best.Severity
+	if len(best.URLs) != 0 {
+		vuln.Link = best.URLs[0]
+	}
+}
+
+// severityRank orders grype's severity labels from lowest to highest so
+// callers can pick the most severe of several candidates.
+func severityRank(severity string) int {
+	switch strings.ToLower(severity) {
+	case "critical":
+		return 4
+	case "high":
+		return 3
+	case "medium":
+		return 2
+	case "low":
+		return 1
+	case "negligible":
+		return 0
+	default:
+		return -1
 	}
-	log.Println("after GetAnchoreScanRes " + scanCmd.ImageTag)
+}
 
-	LayersVulnsList, err := AnchoreStructConversion(anchore_vuln_struct)
+// GetAnchoreScanResults runs the selected Scanner and, when KUBEVULN_INCLUDE_SBOM
+// is set to "true", also catalogs the image into a CycloneDX SBOM so callers can persist
+// it once and re-query vulnerabilities later without rescanning.
+func GetAnchoreScanResults(scanCmd *wssc.WebsocketScanCommand) (*ScanResult, error) {
+	scanner := scannerFromEnv()
+
+	log.Println("before Scan " + scanCmd.ImageTag + " via " + scanner.Name())
+	LayersVulnsList, err := scanner.Scan(context.Background(), scanCmd)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("after AnchoreStructConversion " + scanCmd.ImageTag)
+	log.Println("after Scan " + scanCmd.ImageTag + " via " + scanner.Name())
+
+	report := BuildReport(LayersVulnsList)
+	result := &ScanResult{Layers: LayersVulnsList, Report: report}
+
+	if os.Getenv(includeSBOMEnvVar) == "true" {
+		sbom, err := GetAnchoreSBOM(scanCmd)
+		if err != nil {
+			log.Printf("warning: failed to generate SBOM for %s: %v", scanCmd.ImageTag, err)
+		} else {
+			result.SBOM = sbom
+		}
+	}
+
+	if err := checkSeverityThreshold(report); err != nil {
+		return result, err
+	}
 
-	return LayersVulnsList, nil
+	return result, nil
 }
\ No newline at end of file
@@ -0,0 +1,137 @@
+package process_request
+
+import (
+	"strings"
+	"testing"
+
+	cs "github.com/armosec/capacketsgo/containerscan"
+)
+
+func TestSeverityRank(t *testing.T) {
+	cases := []struct {
+		severity string
+		want     int
+	}{
+		{"Critical", 4},
+		{"high", 3},
+		{"Medium", 2},
+		{"low", 1},
+		{"Negligible", 0},
+		{"unknown", -1},
+	}
+
+	for _, c := range cases {
+		if got := severityRank(c.severity); got != c.want {
+			t.Errorf("severityRank(%q) = %d, want %d", c.severity, got, c.want)
+		}
+	}
+}
+
+func TestOrientVulnerabilityByCVE(t *testing.T) {
+	match := Match{
+		RelatedVulnerabilities: []VulnerabilityMetadata{
+			{ID: "CVE-2021-0001", Severity: "Low", Description: "low severity cve"},
+			{ID: "CVE-2021-0002", Severity: "Critical", Description: "critical cve", URLs: []string{"https://example.com/cve-2021-0002"}},
+			{ID: "ELSA-2021-9999", Severity: "High", Description: "not a cve, should be ignored"},
+		},
+	}
+
+	vuln := &cs.Vulnerability{Name: "GHSA-xxxx-yyyy-zzzz", Severity: "Medium"}
+	orientVulnerabilityByCVE(vuln, match)
+
+	if vuln.Name != "CVE-2021-0002" {
+		t.Errorf("Name = %q, want the highest-severity related CVE", vuln.Name)
+	}
+	if vuln.Severity != "Critical" {
+		t.Errorf("Severity = %q, want %q", vuln.Severity, "Critical")
+	}
+	if vuln.Link != "https://example.com/cve-2021-0002" {
+		t.Errorf("Link = %q, want the chosen CVE's first URL", vuln.Link)
+	}
+	if !strings.Contains(vuln.Description, "GHSA-xxxx-yyyy-zzzz") {
+		t.Errorf("Description = %q, want it to retain the original advisory ID", vuln.Description)
+	}
+}
+
+func TestOrientVulnerabilityByCVE_NoRelatedCVE(t *testing.T) {
+	match := Match{
+		RelatedVulnerabilities: []VulnerabilityMetadata{
+			{ID: "ELSA-2021-9999", Severity: "High"},
+		},
+	}
+
+	vuln := &cs.Vulnerability{Name: "ELSA-2021-9999", Severity: "High"}
+	orientVulnerabilityByCVE(vuln, match)
+
+	if vuln.Name != "ELSA-2021-9999" {
+		t.Errorf("Name = %q, want it left unchanged when no related CVE exists", vuln.Name)
+	}
+}
+
+// fakePackageHandler returns a canned file list per package name, so
+// GetPackagesInLayer can be exercised without a real RPM/APK database.
+type fakePackageHandler struct {
+	filesByPackage map[string][]string
+}
+
+func (h *fakePackageHandler) readFileListForPackage(packageName string) (*[]string, error) {
+	files := h.filesByPackage[packageName]
+	return &files, nil
+}
+
+func (h *fakePackageHandler) GetType() string {
+	return "fake"
+}
+
+func searchedByPackage(name string) interface{} {
+	return map[string]interface{}{
+		"package": map[string]interface{}{"name": name},
+	}
+}
+
+func TestGetPackagesInLayerReturnsEveryMatchedPackage(t *testing.T) {
+	report := &JSONReport{
+		Matches: []Match{
+			{
+				MatchDetails: []MatchDetails{
+					{SearchedBy: searchedByPackage("openssl")},
+				},
+			},
+			{
+				MatchDetails: []MatchDetails{
+					{SearchedBy: searchedByPackage("curl")},
+				},
+			},
+			// A second match against a package already seen should not add
+			// a duplicate entry.
+			{
+				MatchDetails: []MatchDetails{
+					{SearchedBy: searchedByPackage("openssl")},
+				},
+			},
+		},
+	}
+
+	handler := &fakePackageHandler{filesByPackage: map[string][]string{
+		"openssl": {"/usr/lib/libssl.so"},
+		"curl":    {"/usr/bin/curl"},
+	}}
+
+	packages := GetPackagesInLayer("layer1", report, handler)
+
+	if len(packages) != 2 {
+		t.Fatalf("len(packages) = %d, want 2 (one per distinct matched package)", len(packages))
+	}
+
+	byName := make(map[string]cs.PkgFiles, len(packages))
+	for _, p := range packages {
+		byName[p.PackageName] = p.Files
+	}
+
+	if len(byName["openssl"]) != 1 || byName["openssl"][0].Filename != "/usr/lib/libssl.so" {
+		t.Errorf("openssl files = %v, want [/usr/lib/libssl.so]", byName["openssl"])
+	}
+	if len(byName["curl"]) != 1 || byName["curl"][0].Filename != "/usr/bin/curl" {
+		t.Errorf("curl files = %v, want [/usr/bin/curl]", byName["curl"])
+	}
+}
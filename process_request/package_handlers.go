@@ -0,0 +1,449 @@
+package process_request
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	rpmdb "github.com/knqyf263/go-rpmdb/pkg"
+
+	stereofile "github.com/anchore/stereoscope/pkg/file"
+	"github.com/anchore/stereoscope/pkg/image"
+)
+
+// PackageHandler resolves the files owned by an installed package on a given
+// distro.
+type PackageHandler interface {
+	readFileListForPackage(packageName string) (*[]string, error)
+	GetType() string
+}
+
+// PackageHandlerForDistro picks the PackageHandler for the distro grype
+// reported. img is the stereoscope image the scan pulled; handlers read
+// layerDigest's package database out of it.
+func PackageHandlerForDistro(distro distribution, layerDigest string, img *image.Image) PackageHandler {
+	idLike := strings.ToLower(distro.IDLike)
+	name := strings.ToLower(distro.Name)
+
+	switch {
+	case name == "alpine":
+		return newAPKHandler(layerDigest, img)
+	case name == "rhel" || name == "centos" || name == "fedora" || name == "amazonlinux" ||
+		strings.Contains(idLike, "rhel") || strings.Contains(idLike, "fedora"):
+		return newRPMHandler(layerDigest, img)
+	default:
+		return newDPKGHandler(layerDigest, img)
+	}
+}
+
+// packageFileListCache is a small, process-wide LRU keyed by
+// (layerDigest, packageName) so repeated matches against the same layer
+// don't re-parse the RPM/APK package database from scratch.
+var packageFileListCache = newFileListLRU(2048)
+
+type fileListCacheKey struct {
+	layerDigest string
+	packageName string
+}
+
+type fileListLRU struct {
+	mu       sync.Mutex
+	capacity int
+	order    []fileListCacheKey
+	entries  map[fileListCacheKey][]string
+}
+
+func newFileListLRU(capacity int) *fileListLRU {
+	return &fileListLRU{
+		capacity: capacity,
+		entries:  make(map[fileListCacheKey][]string, capacity),
+	}
+}
+
+func (c *fileListLRU) get(key fileListCacheKey) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, ok := c.entries[key]
+	if ok {
+		c.markRecentlyUsed(key)
+	}
+	return files, ok
+}
+
+func (c *fileListLRU) add(key fileListCacheKey, files []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; exists {
+		c.markRecentlyUsed(key)
+	} else {
+		if len(c.order) >= c.capacity {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.entries, oldest)
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = files
+}
+
+// markRecentlyUsed moves key to the back of order, the most-recently-used end.
+func (c *fileListLRU) markRecentlyUsed(key fileListCacheKey) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
+
+// openLayerFile resolves path inside the layer identified by layerDigest
+// within img.
+func openLayerFile(img *image.Image, layerDigest, path string) (io.ReadCloser, error) {
+	if img == nil {
+		return nil, fmt.Errorf("no image available to resolve %s (layer %s)", path, layerDigest)
+	}
+
+	for _, layer := range img.Layers {
+		if layer.Metadata.Digest != layerDigest {
+			continue
+		}
+
+		ref, err := layer.Tree.File(stereofile.Path(path))
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			return nil, fmt.Errorf("%s not found in layer %s", path, layerDigest)
+		}
+
+		return img.FileCatalog.Open(*ref)
+	}
+
+	return nil, fmt.Errorf("layer %s not found in image", layerDigest)
+}
+
+// extractLayerFileToTemp copies the file at path in layerDigest to a local
+// temp file, for readers like go-rpmdb that need a real path on disk. The
+// caller is responsible for removing the temp file.
+func extractLayerFileToTemp(img *image.Image, layerDigest, path string) (string, error) {
+	r, err := openLayerFile(img, layerDigest, path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "kubevuln-pkgdb-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// rpmDBCandidates lists the RPM database files this handler knows how to
+// open, in the order they're tried: the sqlite backend RHEL 8/9 and current
+// Fedora default to, the NDB backend some SUSE releases use, and finally the
+// legacy BerkeleyDB file. go-rpmdb needs the concrete file path, it can't
+// discover the right one from a directory on its own.
+var rpmDBCandidates = []string{
+	"/var/lib/rpm/rpmdb.sqlite",
+	"/var/lib/rpm/Packages.db",
+	"/var/lib/rpm/Packages",
+}
+
+// rpmLayerFilesCache caches, per layerDigest, every installed package's file
+// list parsed from that layer's RPM database - so a layer's RPM database is
+// parsed at most once, no matter how many distinct packages are matched
+// against it.
+var rpmLayerFilesCache = newLayerFilesCache(256)
+
+type layerFilesCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	entries  map[string]map[string][]string
+}
+
+func newLayerFilesCache(capacity int) *layerFilesCache {
+	return &layerFilesCache{
+		capacity: capacity,
+		entries:  make(map[string]map[string][]string, capacity),
+	}
+}
+
+func (c *layerFilesCache) get(layerDigest string) (map[string][]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	filesByPackage, ok := c.entries[layerDigest]
+	return filesByPackage, ok
+}
+
+func (c *layerFilesCache) add(layerDigest string, filesByPackage map[string][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[layerDigest]; !exists {
+		if len(c.order) >= c.capacity {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.entries, oldest)
+		}
+		c.order = append(c.order, layerDigest)
+	}
+	c.entries[layerDigest] = filesByPackage
+}
+
+// rpmHandler resolves package file lists from the RPM database of a single
+// image layer.
+type rpmHandler struct {
+	layerDigest string
+	img         *image.Image
+}
+
+func newRPMHandler(layerDigest string, img *image.Image) *rpmHandler {
+	return &rpmHandler{layerDigest: layerDigest, img: img}
+}
+
+func (h *rpmHandler) GetType() string {
+	return "rpm"
+}
+
+// openRPMDB tries each of rpmDBCandidates in turn against layerDigest in img and
+// returns the first one that opens successfully, plus a cleanup func for the
+// temp file it was extracted to.
+func openRPMDB(img *image.Image, layerDigest string) (*rpmdb.RpmDB, func(), error) {
+	var lastErr error
+	for _, candidate := range rpmDBCandidates {
+		tmpPath, err := extractLayerFileToTemp(img, layerDigest, candidate)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		db, err := rpmdb.Open(tmpPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			lastErr = err
+			continue
+		}
+
+		return db, func() { os.Remove(tmpPath) }, nil
+	}
+
+	return nil, nil, fmt.Errorf("no readable RPM database found in layer %s (tried %s): %w", layerDigest, strings.Join(rpmDBCandidates, ", "), lastErr)
+}
+
+// layerPackageFiles returns the installed-package-name -> file list mapping
+// for h's layer, parsing the RPM database once per layer via
+// rpmLayerFilesCache rather than once per matched package.
+func (h *rpmHandler) layerPackageFiles() (map[string][]string, error) {
+	if cached, ok := rpmLayerFilesCache.get(h.layerDigest); ok {
+		return cached, nil
+	}
+
+	db, cleanup, err := openRPMDB(h.img, h.layerDigest)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	defer db.Close()
+
+	packages, err := db.ListPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	filesByPackage := make(map[string][]string, len(packages))
+	for _, pkg := range packages {
+		installedFiles, err := pkg.InstalledFiles()
+		if err != nil {
+			continue
+		}
+		files := make([]string, 0, len(installedFiles))
+		for _, f := range installedFiles {
+			files = append(files, f.Path)
+		}
+		filesByPackage[pkg.Name] = files
+	}
+
+	rpmLayerFilesCache.add(h.layerDigest, filesByPackage)
+	return filesByPackage, nil
+}
+
+func (h *rpmHandler) readFileListForPackage(packageName string) (*[]string, error) {
+	key := fileListCacheKey{layerDigest: h.layerDigest, packageName: packageName}
+	if cached, ok := packageFileListCache.get(key); ok {
+		return &cached, nil
+	}
+
+	filesByPackage, err := h.layerPackageFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	files, ok := filesByPackage[packageName]
+	if !ok {
+		files = filesByPackage[normalizeRPMPackageName(packageName)]
+	}
+
+	packageFileListCache.add(key, files)
+	return &files, nil
+}
+
+// normalizeRPMPackageName maps a sub-package name (e.g. a "-libs" or
+// "-devel" split) back to the source package name, mirroring the dpkg
+// pkgResolved remapping.
+func normalizeRPMPackageName(packageName string) string {
+	for _, suffix := range []string{"-libs", "-devel", "-utils", "-common"} {
+		if strings.HasSuffix(packageName, suffix) {
+			return strings.TrimSuffix(packageName, suffix)
+		}
+	}
+	return packageName
+}
+
+// apkInstalledDBPath is Alpine's installed-package database.
+const apkInstalledDBPath = "/lib/apk/db/installed"
+
+// apkHandler resolves package file lists from Alpine's installed package
+// database, a flat text format with one "key:value" pair per line and
+// packages separated by blank lines.
+type apkHandler struct {
+	layerDigest string
+	img         *image.Image
+}
+
+func newAPKHandler(layerDigest string, img *image.Image) *apkHandler {
+	return &apkHandler{layerDigest: layerDigest, img: img}
+}
+
+func (h *apkHandler) GetType() string {
+	return "apk"
+}
+
+func (h *apkHandler) readFileListForPackage(packageName string) (*[]string, error) {
+	key := fileListCacheKey{layerDigest: h.layerDigest, packageName: packageName}
+	if cached, ok := packageFileListCache.get(key); ok {
+		return &cached, nil
+	}
+
+	r, err := openLayerFile(h.img, h.layerDigest, apkInstalledDBPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := normalizeAPKPackageName(packageName)
+	files := parseAPKInstalledDB(raw, packageName, normalized)
+
+	packageFileListCache.add(key, files)
+	return &files, nil
+}
+
+// normalizeAPKPackageName strips the -dev/-doc/-lang sub-package suffixes
+// Alpine uses, mapping them back to the origin package (origin "o:" entry).
+func normalizeAPKPackageName(packageName string) string {
+	for _, suffix := range []string{"-dev", "-doc", "-lang", "-openrc"} {
+		if strings.HasSuffix(packageName, suffix) {
+			return strings.TrimSuffix(packageName, suffix)
+		}
+	}
+	return packageName
+}
+
+// parseAPKInstalledDB scans the apk installed-packages file for the record
+// whose name ("P:") or origin ("o:") matches packageName or normalizedName,
+// and returns its file list built from directory ("F:") and regular file
+// ("R:") entries.
+func parseAPKInstalledDB(raw []byte, packageName, normalizedName string) []string {
+	files := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+
+	matches := false
+	dir := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			matches = false
+			dir = ""
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "P:"):
+			name := strings.TrimPrefix(line, "P:")
+			matches = name == packageName || name == normalizedName
+		case strings.HasPrefix(line, "o:"):
+			origin := strings.TrimPrefix(line, "o:")
+			if origin == packageName || origin == normalizedName {
+				matches = true
+			}
+		case matches && strings.HasPrefix(line, "F:"):
+			dir = strings.TrimPrefix(line, "F:")
+		case matches && strings.HasPrefix(line, "R:"):
+			files = append(files, "/"+strings.TrimPrefix(dir+"/"+strings.TrimPrefix(line, "R:"), "/"))
+		}
+	}
+
+	return files
+}
+
+// dpkgInfoDir holds dpkg's per-package file lists: one "<package>.list" file
+// per installed package, with one absolute path per line.
+const dpkgInfoDir = "/var/lib/dpkg/info"
+
+// dpkgHandler resolves package file lists from a package's "<package>.list"
+// file under dpkgInfoDir.
+type dpkgHandler struct {
+	layerDigest string
+	img         *image.Image
+}
+
+func newDPKGHandler(layerDigest string, img *image.Image) *dpkgHandler {
+	return &dpkgHandler{layerDigest: layerDigest, img: img}
+}
+
+func (h *dpkgHandler) GetType() string {
+	return "dpkg"
+}
+
+func (h *dpkgHandler) readFileListForPackage(packageName string) (*[]string, error) {
+	key := fileListCacheKey{layerDigest: h.layerDigest, packageName: packageName}
+	if cached, ok := packageFileListCache.get(key); ok {
+		return &cached, nil
+	}
+
+	r, err := openLayerFile(h.img, h.layerDigest, dpkgInfoDir+"/"+packageName+".list")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		files = append(files, scanner.Text())
+	}
+
+	packageFileListCache.add(key, files)
+	return &files, nil
+}
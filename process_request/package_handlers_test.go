@@ -0,0 +1,115 @@
+package process_request
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAPKInstalledDB(t *testing.T) {
+	db := []byte(
+		"P:musl\n" +
+			"V:1.2.3-r0\n" +
+			"F:usr/lib\n" +
+			"R:libc.musl-x86_64.so.1\n" +
+			"\n" +
+			"P:busybox-extras\n" +
+			"o:busybox\n" +
+			"F:usr/sbin\n" +
+			"R:busybox\n" +
+			"F:\n" +
+			"R:root-file\n",
+	)
+
+	files := parseAPKInstalledDB(db, "musl", "musl")
+	want := []string{"/usr/lib/libc.musl-x86_64.so.1"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("musl files = %v, want %v", files, want)
+	}
+
+	// Matches on the origin ("o:") entry, as a -dev/-doc sub-package would.
+	files = parseAPKInstalledDB(db, "busybox-dev", "busybox")
+	want = []string{"/usr/sbin/busybox", "/root-file"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("busybox-dev files = %v, want %v", files, want)
+	}
+
+	if files := parseAPKInstalledDB(db, "nope", "nope"); len(files) != 0 {
+		t.Errorf("unmatched package files = %v, want empty", files)
+	}
+}
+
+func TestRPMHandlerServesDistinctPackagesFromOneCachedLayerParse(t *testing.T) {
+	layerDigest := "sha256:rpmhandlertestlayer"
+	rpmLayerFilesCache.add(layerDigest, map[string][]string{
+		"openssl": {"/usr/lib64/libssl.so"},
+	})
+
+	// img is nil: if readFileListForPackage tried to re-open the RPM database
+	// instead of using the cached per-layer parse, this would fail.
+	h := newRPMHandler(layerDigest, nil)
+
+	files, err := h.readFileListForPackage("openssl")
+	if err != nil {
+		t.Fatalf("readFileListForPackage(%q) error = %v", "openssl", err)
+	}
+	want := []string{"/usr/lib64/libssl.so"}
+	if !reflect.DeepEqual(*files, want) {
+		t.Errorf("openssl files = %v, want %v", *files, want)
+	}
+
+	// A distinct, previously-unseen package name sharing the same layer
+	// should also resolve from the cached parse, via normalizeRPMPackageName.
+	files, err = h.readFileListForPackage("openssl-libs")
+	if err != nil {
+		t.Fatalf("readFileListForPackage(%q) error = %v", "openssl-libs", err)
+	}
+	if !reflect.DeepEqual(*files, want) {
+		t.Errorf("openssl-libs files = %v, want %v", *files, want)
+	}
+}
+
+func TestLayerFilesCacheEvictsLeastRecentlyAdded(t *testing.T) {
+	cache := newLayerFilesCache(2)
+
+	cache.add("layerA", map[string][]string{"pkg": {"a"}})
+	cache.add("layerB", map[string][]string{"pkg": {"b"}})
+	cache.add("layerC", map[string][]string{"pkg": {"c"}})
+
+	if _, ok := cache.get("layerA"); ok {
+		t.Errorf("layerA should have been evicted once capacity was exceeded")
+	}
+	if _, ok := cache.get("layerB"); !ok {
+		t.Errorf("layerB should still be cached")
+	}
+	if _, ok := cache.get("layerC"); !ok {
+		t.Errorf("layerC should still be cached")
+	}
+}
+
+func TestFileListLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	lru := newFileListLRU(2)
+
+	keyA := fileListCacheKey{layerDigest: "layer", packageName: "a"}
+	keyB := fileListCacheKey{layerDigest: "layer", packageName: "b"}
+	keyC := fileListCacheKey{layerDigest: "layer", packageName: "c"}
+
+	lru.add(keyA, []string{"a"})
+	lru.add(keyB, []string{"b"})
+
+	// Touching A makes B the least-recently-used entry.
+	if _, ok := lru.get(keyA); !ok {
+		t.Fatalf("expected keyA to be cached")
+	}
+
+	lru.add(keyC, []string{"c"})
+
+	if _, ok := lru.get(keyB); ok {
+		t.Errorf("keyB should have been evicted, but is still cached")
+	}
+	if _, ok := lru.get(keyA); !ok {
+		t.Errorf("keyA should still be cached")
+	}
+	if _, ok := lru.get(keyC); !ok {
+		t.Errorf("keyC should still be cached")
+	}
+}
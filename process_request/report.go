@@ -0,0 +1,141 @@
+package process_request
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	cs "github.com/armosec/capacketsgo/containerscan"
+)
+
+// Severity orders grype's severity labels so a configured threshold can be
+// compared against a scan result with a simple >=.
+type Severity int
+
+const (
+	NegligibleSeverity Severity = iota
+	LowSeverity
+	MediumSeverity
+	HighSeverity
+	CriticalSeverity
+)
+
+// ParseSeverity resolves a severity name (as configured via
+// Application.FailOn) into its Severity ordinal. ok is false for an
+// unrecognized name.
+func ParseSeverity(name string) (severity Severity, ok bool) {
+	switch strings.ToLower(name) {
+	case "negligible":
+		return NegligibleSeverity, true
+	case "low":
+		return LowSeverity, true
+	case "medium":
+		return MediumSeverity, true
+	case "high":
+		return HighSeverity, true
+	case "critical":
+		return CriticalSeverity, true
+	default:
+		return 0, false
+	}
+}
+
+// appConfig holds the process-wide Application settings (fail-on severity,
+// db location, ...) set once at startup via SetApplicationConfig. Per-scan
+// state such as registry credentials stays on WebsocketScanCommand instead.
+var appConfig Application
+
+// SetApplicationConfig records the process-wide Application config that
+// GetAnchoreScanResults consults for severity gating.
+func SetApplicationConfig(app Application) {
+	appConfig = app
+}
+
+// VulnerabilityReport is a de-duplicated, severity-bucketed summary of a scan.
+type VulnerabilityReport struct {
+	ImageTag          string
+	ImageDigest       string
+	ScannedAt         time.Time
+	Vulns             []cs.Vulnerability
+	VulnsBySeverity   map[string][]cs.Vulnerability
+	FixableCount      int
+	CriticalHighCount int
+}
+
+// BuildReport de-duplicates vulnerabilities across layers by
+// (Name, RelatedPackageName, PackageVersion) and buckets them by severity.
+func BuildReport(layers *cs.LayersList) *VulnerabilityReport {
+	report := &VulnerabilityReport{
+		ScannedAt:       time.Now(),
+		VulnsBySeverity: make(map[string][]cs.Vulnerability),
+	}
+
+	if layers == nil {
+		return report
+	}
+
+	seen := make(map[string]bool)
+	for _, layer := range *layers {
+		for _, vuln := range layer.Vulnerabilities {
+			if report.ImageTag == "" {
+				report.ImageTag = vuln.ImgTag
+			}
+			if report.ImageDigest == "" {
+				report.ImageDigest = vuln.ImgHash
+			}
+
+			dedupeKey := vuln.Name + "|" + vuln.RelatedPackageName + "|" + vuln.PackageVersion
+			if seen[dedupeKey] {
+				continue
+			}
+			seen[dedupeKey] = true
+
+			report.Vulns = append(report.Vulns, vuln)
+
+			severityKey := strings.ToLower(vuln.Severity)
+			report.VulnsBySeverity[severityKey] = append(report.VulnsBySeverity[severityKey], vuln)
+
+			if len(vuln.Fixes) > 0 && vuln.Fixes[0].Version != "" {
+				report.FixableCount++
+			}
+			if severityRank(vuln.Severity) >= int(HighSeverity) {
+				report.CriticalHighCount++
+			}
+		}
+	}
+
+	return report
+}
+
+// SeverityThresholdError is returned by GetAnchoreScanResults when the scan
+// found vulnerabilities at or above Application.FailOn.
+type SeverityThresholdError struct {
+	Threshold       Severity
+	Vulnerabilities []cs.Vulnerability
+}
+
+func (e *SeverityThresholdError) Error() string {
+	return fmt.Sprintf("%d vulnerabilities meet or exceed the configured fail-on severity", len(e.Vulnerabilities))
+}
+
+// checkSeverityThreshold returns a *SeverityThresholdError when appConfig.FailOn
+// is set and report contains vulnerabilities at or above that severity.
+func checkSeverityThreshold(report *VulnerabilityReport) error {
+	threshold, ok := ParseSeverity(appConfig.FailOn)
+	if !ok {
+		return nil
+	}
+
+	var flagged []cs.Vulnerability
+	for _, vuln := range report.Vulns {
+		if severityRank(vuln.Severity) >= int(threshold) {
+			flagged = append(flagged, vuln)
+		}
+	}
+
+	if len(flagged) == 0 {
+		return nil
+	}
+
+	return &SeverityThresholdError{Threshold: threshold, Vulnerabilities: flagged}
+}
@@ -0,0 +1,63 @@
+package process_request
+
+import (
+	"testing"
+
+	cs "github.com/armosec/capacketsgo/containerscan"
+)
+
+func TestBuildReportDedupesAndBucketsBySeverity(t *testing.T) {
+	layers := cs.LayersList{
+		{
+			LayerHash: "layer1",
+			Vulnerabilities: cs.VulnerabilitiesList{
+				{
+					Name: "CVE-2021-0001", RelatedPackageName: "openssl", PackageVersion: "1.0",
+					ImgTag: "example:latest", ImgHash: "sha256:abc", Severity: "Critical",
+					Fixes: []cs.FixedIn{{Version: "1.1"}},
+				},
+				{
+					Name: "CVE-2021-0002", RelatedPackageName: "curl", PackageVersion: "2.0",
+					ImgTag: "example:latest", ImgHash: "sha256:abc", Severity: "Low",
+				},
+			},
+		},
+		{
+			LayerHash: "layer2",
+			Vulnerabilities: cs.VulnerabilitiesList{
+				// Same (Name, RelatedPackageName, PackageVersion) as layer1's
+				// first vuln - should be deduplicated away.
+				{
+					Name: "CVE-2021-0001", RelatedPackageName: "openssl", PackageVersion: "1.0",
+					ImgTag: "example:latest", ImgHash: "sha256:abc", Severity: "Critical",
+					Fixes: []cs.FixedIn{{Version: "1.1"}},
+				},
+			},
+		},
+	}
+
+	report := BuildReport(&layers)
+
+	if len(report.Vulns) != 2 {
+		t.Fatalf("len(Vulns) = %d, want 2 (duplicate across layers collapsed)", len(report.Vulns))
+	}
+	if report.ImageTag != "example:latest" || report.ImageDigest != "sha256:abc" {
+		t.Errorf("ImageTag/ImageDigest = %q/%q, want them taken from the first vuln", report.ImageTag, report.ImageDigest)
+	}
+	if len(report.VulnsBySeverity["critical"]) != 1 || len(report.VulnsBySeverity["low"]) != 1 {
+		t.Errorf("VulnsBySeverity = %+v, want one critical and one low entry", report.VulnsBySeverity)
+	}
+	if report.FixableCount != 1 {
+		t.Errorf("FixableCount = %d, want 1", report.FixableCount)
+	}
+	if report.CriticalHighCount != 1 {
+		t.Errorf("CriticalHighCount = %d, want 1", report.CriticalHighCount)
+	}
+}
+
+func TestBuildReportNilLayers(t *testing.T) {
+	report := BuildReport(nil)
+	if len(report.Vulns) != 0 {
+		t.Errorf("len(Vulns) = %d, want 0 for nil layers", len(report.Vulns))
+	}
+}
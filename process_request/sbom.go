@@ -0,0 +1,85 @@
+package process_request
+
+import (
+	"fmt"
+
+	cyclonedx "github.com/CycloneDX/cyclonedx-go"
+
+	"github.com/anchore/grype/grype/pkg"
+
+	wssc "github.com/armosec/capacketsgo/apis"
+	cs "github.com/armosec/capacketsgo/containerscan"
+)
+
+// includeSBOMEnvVar opts GetAnchoreScanResults into also cataloging an SBOM
+// alongside the vulnerability scan.
+const includeSBOMEnvVar = "KUBEVULN_INCLUDE_SBOM"
+
+// ScanResult bundles the per-layer vulnerability findings with the SBOM
+// cataloged for the same image.
+type ScanResult struct {
+	Layers *cs.LayersList
+	SBOM   *cyclonedx.BOM
+	Report *VulnerabilityReport
+}
+
+// GetAnchoreSBOM catalogs scanCmd.ImageTag the same way GetAnchoreScanRes
+// does and returns the result as a CycloneDX 1.5 document.
+func GetAnchoreSBOM(scanCmd *wssc.WebsocketScanCommand) (*cyclonedx.BOM, error) {
+	providerConfig := pkg.ProviderConfig{
+		SyftProviderConfig: pkg.SyftProviderConfig{
+			RegistryOptions: registryOptionsForCredentials(scanCmd.Credentials),
+		},
+	}
+
+	packages, _, _, err := pkg.Provide(scanCmd.ImageTag, providerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCycloneDXBOM(packages), nil
+}
+
+func newCycloneDXBOM(packages []pkg.Package) *cyclonedx.BOM {
+	bom := cyclonedx.NewBOM()
+	bom.SpecVersion = cyclonedx.SpecVersion1_5
+
+	components := make([]cyclonedx.Component, 0, len(packages))
+	for _, p := range packages {
+		component := cyclonedx.Component{
+			BOMRef:     p.PURL,
+			Name:       p.Name,
+			Version:    p.Version,
+			Type:       cyclonedx.ComponentTypeLibrary,
+			PackageURL: p.PURL,
+		}
+
+		if len(p.CPEs) > 0 {
+			component.CPE = p.CPEs[0].String()
+		}
+
+		// Hashes intentionally left unset: Locations[].RealPath is a path
+		// inside the scanned image's virtual filesystem, not on the local
+		// disk of whatever process is running this scan (images are
+		// routinely scanned straight from a registry), so there's no file
+		// here to hash. Revisit once component hashing can read through the
+		// stereoscope image/file-catalog API instead of the local FS.
+
+		locations := p.Locations.ToSlice()
+		properties := make([]cyclonedx.Property, 0, len(locations))
+		for i, location := range locations {
+			properties = append(properties, cyclonedx.Property{
+				Name:  fmt.Sprintf("syft:location:%d:layerID", i),
+				Value: location.FileSystemID,
+			})
+		}
+		if len(properties) > 0 {
+			component.Properties = &properties
+		}
+
+		components = append(components, component)
+	}
+
+	bom.Components = &components
+	return bom
+}
@@ -0,0 +1,31 @@
+package process_request
+
+import (
+	"testing"
+
+	"github.com/anchore/grype/grype/pkg"
+)
+
+func TestNewCycloneDXBOM(t *testing.T) {
+	packages := []pkg.Package{
+		{
+			Name:    "openssl",
+			Version: "1.1.1",
+			PURL:    "pkg:apk/alpine/openssl@1.1.1",
+		},
+	}
+
+	bom := newCycloneDXBOM(packages)
+
+	if bom.Components == nil || len(*bom.Components) != 1 {
+		t.Fatalf("Components = %v, want 1 component", bom.Components)
+	}
+
+	component := (*bom.Components)[0]
+	if component.Name != "openssl" || component.Version != "1.1.1" {
+		t.Errorf("component = %+v, want Name/Version carried over from the package", component)
+	}
+	if component.BOMRef != "pkg:apk/alpine/openssl@1.1.1" {
+		t.Errorf("BOMRef = %q, want the package PURL", component.BOMRef)
+	}
+}
@@ -0,0 +1,173 @@
+package process_request
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+
+	wssc "github.com/armosec/capacketsgo/apis"
+	cs "github.com/armosec/capacketsgo/containerscan"
+)
+
+// scannerEnvVar selects the scan backend for GetAnchoreScanResults. Defaults
+// to grype when unset or unrecognized.
+const scannerEnvVar = "KUBEVULN_SCANNER"
+
+// orientByCVEEnvVar opts AnchoreStructConversion into re-keying vendor
+// advisory matches (GHSA, ELSA, ALAS, ...) onto their related CVE.
+const orientByCVEEnvVar = "KUBEVULN_ORIENT_BY_CVE"
+
+func orientByCVEFromEnv() bool {
+	return strings.EqualFold(os.Getenv(orientByCVEEnvVar), "true")
+}
+
+// Scanner is a pluggable vulnerability-scanning backend. Operators can choose
+// one via KUBEVULN_SCANNER to compare engine coverage or fall back when one
+// backend's database is unavailable, without downstream consumers of
+// cs.LayersList noticing the difference.
+type Scanner interface {
+	Scan(ctx context.Context, scanCmd *wssc.WebsocketScanCommand) (*cs.LayersList, error)
+	Name() string
+}
+
+// scannerFromEnv resolves the Scanner selected by KUBEVULN_SCANNER.
+func scannerFromEnv() Scanner {
+	switch strings.ToLower(os.Getenv(scannerEnvVar)) {
+	case "trivy":
+		return &trivyScanner{}
+	default:
+		return &grypeScanner{}
+	}
+}
+
+// grypeScanner is the original grype-backed scanner: catalog with syft, match
+// with grype, then reshape into cs.LayersList.
+type grypeScanner struct{}
+
+func (g *grypeScanner) Name() string {
+	return "grype"
+}
+
+func (g *grypeScanner) Scan(_ context.Context, scanCmd *wssc.WebsocketScanCommand) (*cs.LayersList, error) {
+	anchoreVulnStruct, err := GetAnchoreScanRes(scanCmd)
+	if err != nil {
+		return nil, err
+	}
+	defer anchoreVulnStruct.Close()
+
+	return AnchoreStructConversion(anchoreVulnStruct, orientByCVEFromEnv())
+}
+
+// trivyScanner shells out to the trivy CLI and maps its per-layer results
+// into cs.ScanResultLayer, mirroring the shape grypeScanner produces.
+type trivyScanner struct{}
+
+func (t *trivyScanner) Name() string {
+	return "trivy"
+}
+
+type trivyReport struct {
+	Metadata trivyMetadata `json:"Metadata"`
+	Results  []trivyResult `json:"Results"`
+}
+
+type trivyMetadata struct {
+	ImageID     string   `json:"ImageID"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+type trivyResult struct {
+	Target          string               `json:"Target"`
+	Vulnerabilities []trivyVulnerability `json:"Vulnerabilities"`
+}
+
+type trivyVulnerability struct {
+	VulnerabilityID  string     `json:"VulnerabilityID"`
+	PkgName          string     `json:"PkgName"`
+	InstalledVersion string     `json:"InstalledVersion"`
+	FixedVersion     string     `json:"FixedVersion"`
+	Severity         string     `json:"Severity"`
+	Description      string     `json:"Description"`
+	Layer            trivyLayer `json:"Layer"`
+}
+
+type trivyLayer struct {
+	Digest string `json:"Digest"`
+}
+
+func (t *trivyScanner) Scan(ctx context.Context, scanCmd *wssc.WebsocketScanCommand) (*cs.LayersList, error) {
+	cmd := exec.CommandContext(ctx, "trivy", "image", "--format", "json", scanCmd.ImageTag)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	var report trivyReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		return nil, err
+	}
+
+	return trivyReportToLayers(&report, scanCmd.ImageTag), nil
+}
+
+// trivyReportToLayers regroups trivy's vulnerabilities, which are reported
+// per scan target (an OS layer, a lockfile, ...), by the image layer digest
+// each one carries in Layer.Digest. This lines up LayerHash/ImgHash with what
+// grypeScanner/AnchoreStructConversion produce: a real layer digest and the
+// image's manifest digest, respectively. A vulnerability with no Layer.Digest
+// is grouped under its result Target instead, and ImgHash is
+// Metadata.ImageID when the report has no RepoDigests.
+func trivyReportToLayers(report *trivyReport, imageTag string) *cs.LayersList {
+	imgHash := report.Metadata.ImageID
+	if len(report.Metadata.RepoDigests) != 0 {
+		imgHash = report.Metadata.RepoDigests[0]
+	}
+
+	layerOrder := make([]string, 0)
+	vulnsByLayer := make(map[string]cs.VulnerabilitiesList)
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			layerHash := v.Layer.Digest
+			if layerHash == "" {
+				layerHash = result.Target
+			}
+			if _, ok := vulnsByLayer[layerHash]; !ok {
+				layerOrder = append(layerOrder, layerHash)
+				vulnsByLayer[layerHash] = make(cs.VulnerabilitiesList, 0)
+			}
+
+			vulnsByLayer[layerHash] = append(vulnsByLayer[layerHash], cs.Vulnerability{
+				Name:               v.VulnerabilityID,
+				ImgHash:            imgHash,
+				ImgTag:             imageTag,
+				RelatedPackageName: v.PkgName,
+				PackageVersion:     v.InstalledVersion,
+				Description:        v.Description,
+				Severity:           v.Severity,
+				Fixes: []cs.FixedIn{
+					{
+						ImgTag:  imageTag,
+						Version: v.FixedVersion,
+					},
+				},
+			})
+		}
+	}
+
+	layersList := make(cs.LayersList, 0, len(layerOrder))
+	parentLayerHash := ""
+	for _, layerHash := range layerOrder {
+		layersList = append(layersList, cs.ScanResultLayer{
+			LayerHash:       layerHash,
+			ParentLayerHash: parentLayerHash,
+			Vulnerabilities: vulnsByLayer[layerHash],
+		})
+		parentLayerHash = layerHash
+	}
+
+	return &layersList
+}
@@ -0,0 +1,51 @@
+package process_request
+
+import (
+	"testing"
+)
+
+func TestTrivyReportToLayers(t *testing.T) {
+	report := &trivyReport{
+		Metadata: trivyMetadata{
+			ImageID:     "sha256:imageid",
+			RepoDigests: []string{"example.com/repo@sha256:digest"},
+		},
+		Results: []trivyResult{
+			{
+				Target: "example:latest (alpine 3.18)",
+				Vulnerabilities: []trivyVulnerability{
+					{VulnerabilityID: "CVE-2021-0001", PkgName: "musl", InstalledVersion: "1.2.3", Layer: trivyLayer{Digest: "sha256:layer1"}},
+					{VulnerabilityID: "CVE-2021-0002", PkgName: "busybox", InstalledVersion: "1.35.0", Layer: trivyLayer{Digest: "sha256:layer2"}},
+				},
+			},
+			{
+				// A lockfile target with no Layer.Digest falls back to result.Target.
+				Target: "app/package-lock.json",
+				Vulnerabilities: []trivyVulnerability{
+					{VulnerabilityID: "CVE-2021-0003", PkgName: "left-pad", InstalledVersion: "1.0.0"},
+				},
+			},
+		},
+	}
+
+	layers := trivyReportToLayers(report, "example:latest")
+	if len(*layers) != 3 {
+		t.Fatalf("len(layers) = %d, want 3", len(*layers))
+	}
+
+	got := (*layers)[0]
+	if got.LayerHash != "sha256:layer1" || got.ParentLayerHash != "" {
+		t.Errorf("layer[0] = %+v, want LayerHash sha256:layer1 with no parent", got)
+	}
+	if len(got.Vulnerabilities) != 1 || got.Vulnerabilities[0].ImgHash != "example.com/repo@sha256:digest" {
+		t.Errorf("layer[0] vuln = %+v, want ImgHash taken from RepoDigests", got.Vulnerabilities)
+	}
+
+	if (*layers)[1].ParentLayerHash != "sha256:layer1" {
+		t.Errorf("layer[1].ParentLayerHash = %q, want sha256:layer1", (*layers)[1].ParentLayerHash)
+	}
+
+	if (*layers)[2].LayerHash != "app/package-lock.json" {
+		t.Errorf("layer[2].LayerHash = %q, want the result Target fallback", (*layers)[2].LayerHash)
+	}
+}